@@ -0,0 +1,117 @@
+package saramaprom
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricMode selects how sarama's go-metrics types are mapped onto
+// Prometheus metric types.
+type MetricMode int
+
+const (
+	// ModeGaugeCompat exposes counters, gauges and meters (their rate1) as
+	// prometheus.Gauge values. Histograms and timers get a gauge too (the
+	// last sample, or the timer's rate1), plus a prometheus.ConstSummary
+	// of their quantiles. This is the default.
+	ModeGaugeCompat MetricMode = iota
+
+	// ModeNative maps each sarama metric onto its closest native
+	// Prometheus type: metrics.Counter becomes a prometheus.Counter,
+	// metrics.Meter becomes a counter for the total event count plus
+	// gauges for rate1/rate5/rate15, and metrics.Histogram/metrics.Timer
+	// become a real prometheus.ConstHistogram, with buckets' cumulative
+	// counts computed from the metric's actual sample values against
+	// histogramBuckets/timerBuckets as latency thresholds. This makes
+	// rate()/histogram_quantile() queries behave correctly at the cost of
+	// changing existing metric names/types.
+	ModeNative
+)
+
+// metricKind records which Prometheus type a sanitized metric name was
+// first registered as.
+type metricKind string
+
+const (
+	kindGauge     metricKind = "gauge"
+	kindCounter   metricKind = "counter"
+	kindHistogram metricKind = "histogram"
+	kindSummary   metricKind = "summary"
+)
+
+// checkMetricConflict fails if metricName was already exposed under a
+// different Prometheus type on an earlier scrape. Without this, a name that
+// starts out as a gauge and is later scraped as a counter (e.g. after an
+// Options.MetricMode change) would silently collide inside the registry.
+func (c *exporter) checkMetricConflict(metricName string, kind metricKind) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.metricKinds[metricName]; ok {
+		if existing != kind {
+			return fmt.Errorf("saramaprom: metric %q already registered as %s, cannot re-register as %s", metricName, existing, kind)
+		}
+		return nil
+	}
+	c.metricKinds[metricName] = kind
+	return nil
+}
+
+// emitCounter resolves the raw sarama metric name and, unless it should be
+// skipped, sends it to ch as a prometheus.CounterValue. sarama's
+// metrics.Counter already holds the cumulative count, so there is no local
+// accumulation to do: ConstMetric counters simply report whatever value is
+// current.
+func (c *exporter) emitCounter(ch chan<- prometheus.Metric, name string, val float64) {
+	shortName, lbls, skip := c.metricNameAndLabels(name)
+	if skip {
+		if c.opt.Debug {
+			fmt.Printf("[saramaprom] skip metric %q because there is no broker or topic labels\n", name)
+		}
+		return
+	}
+	c.emitResolvedCounter(ch, name, shortName, lbls, val)
+}
+
+// emitResolvedCounter is emitCounter for a caller that already resolved
+// shortName/lbls itself.
+func (c *exporter) emitResolvedCounter(ch chan<- prometheus.Metric, rawKey, shortName string, lbls labels, val float64) {
+	metricName := c.sanitizeName(shortName)
+	if c.stale(rawKey, metricName, val) {
+		return
+	}
+	if err := c.checkMetricConflict(metricName, kindCounter); err != nil {
+		if c.opt.Debug {
+			fmt.Printf("[saramaprom] %v\n", err)
+		}
+		return
+	}
+
+	labelNames, labelValues := labelPairs(lbls)
+	desc := prometheus.NewDesc(
+		prometheus.BuildFQName(c.sanitizeName(c.opt.Namespace), c.sanitizeName(c.opt.Subsystem), metricName),
+		shortName,
+		labelNames,
+		nil,
+	)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, val, labelValues...)
+}
+
+// emitMeter maps a sarama metrics.Meter onto a counter for the total event
+// count plus gauges for its decaying rates, mirroring how statsd_exporter's
+// CounterContainer and GaugeContainer split responsibility between
+// cumulative counts and instantaneous rates. name is resolved once so all
+// four derived series share one broker/topic label resolution. Each series
+// is passed a suffixed raw key (name+"_total" and so on), which stale also
+// hands to forget as the labelsMap key, so expiring one of them does not
+// drop the cached label set stored under name.
+func (c *exporter) emitMeter(ch chan<- prometheus.Metric, name string, count, rate1, rate5, rate15 float64) {
+	shortName, lbls, skip := c.metricNameAndLabels(name)
+	if skip {
+		return
+	}
+	c.emitResolvedCounter(ch, name+"_total", shortName+"_total", lbls, count)
+	c.emitResolvedGauge(ch, name+"_rate1", shortName+"_rate1", lbls, rate1)
+	c.emitResolvedGauge(ch, name+"_rate5", shortName+"_rate5", lbls, rate5)
+	c.emitResolvedGauge(ch, name+"_rate15", shortName+"_rate15", lbls, rate15)
+}
@@ -3,9 +3,12 @@ package saramaprom
 // This code is based on a code of https://github.com/deathowl/go-metrics-prometheus library.
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rcrowley/go-metrics"
@@ -13,18 +16,110 @@ import (
 
 type labels map[string]string
 
+// exporter implements prometheus.Collector directly: Collect walks the
+// sarama MetricsRegistry on every scrape and synthesizes ConstMetric values
+// on demand, instead of maintaining a background-updated map of live
+// collectors. The only state kept across scrapes is bookkeeping needed for
+// label stability (labelsMap), type-conflict detection (metricKinds), and
+// TTL expiration (lastValue/lastUpdate/expired).
+//
+// Concurrency: per the prometheus.Collector contract, Collect must be safe
+// to call concurrently with itself (a registry can be scraped by more than
+// one caller). Every map above is only ever touched while holding mu, and
+// baseLabels/mappingRules are populated once in NewUnregistered and never written to
+// afterward, so they're safe to read without a lock.
 type exporter struct {
-	opt              Options
-	registry         MetricsRegistry
-	promRegistry     prometheus.Registerer
-	gauges           map[string]prometheus.Gauge
-	customMetrics    map[string]*customCollector
+	opt          Options
+	registry     MetricsRegistry
+	promRegistry prometheus.Registerer
+
 	histogramBuckets []float64
 	timerBuckets     []float64
-	mu               sync.RWMutex
+	mappingRules     []MappingRule
+
+	// baseLabels is a private copy of opt.Labels taken once in NewUnregistered. We
+	// read it on every scrape to build each metric's label set; copying
+	// it up front means a caller that keeps mutating the map it passed
+	// to Options.Labels can't race with that read.
+	baseLabels labels
+
+	mu sync.RWMutex
 
-	labelsMap      map[string]labels
-	metricsNameMap map[string]bool
+	labelsMap   map[string]labels
+	metricKinds map[string]metricKind
+	lastValue   map[string]float64
+	lastUpdate  map[string]time.Time
+	expired     map[string]bool
+}
+
+// Describe is intentionally empty, making exporter an "unchecked" collector
+// (see prometheus.Collector's doc comment): the set of metric names depends
+// on which brokers/topics sarama currently knows about, so it can't be
+// declared up front.
+func (c *exporter) Describe(_ chan<- *prometheus.Desc) {}
+
+// Collect is called by the Prometheus client on every scrape. It reads the
+// sarama registry fresh each time, so there is no polling loop and no
+// window where a scrape can observe a value older than the last Kafka
+// client activity.
+func (c *exporter) Collect(ch chan<- prometheus.Metric) {
+	if c.opt.Debug {
+		fmt.Print("[saramaprom] Collect()\n")
+	}
+	c.registry.Each(func(name string, i interface{}) {
+		switch metric := i.(type) {
+		case metrics.Counter:
+			if c.opt.MetricMode == ModeNative {
+				c.emitCounter(ch, name, float64(metric.Count()))
+			} else {
+				c.emitGauge(ch, name, float64(metric.Count()))
+			}
+		case metrics.Gauge:
+			c.emitGauge(ch, name, float64(metric.Value()))
+		case metrics.GaugeFloat64:
+			c.emitGauge(ch, name, float64(metric.Value()))
+		case metrics.Histogram: // sarama
+			if c.opt.MetricMode != ModeNative {
+				samples := metric.Snapshot().Sample().Values()
+				if len(samples) > 0 {
+					c.emitGauge(ch, name, float64(samples[len(samples)-1]))
+				}
+			}
+			c.emitHistogram(ch, name, metric, c.histogramBuckets, "histogram")
+		case metrics.Meter: // sarama
+			snapshot := metric.Snapshot()
+			if c.opt.MetricMode == ModeNative {
+				c.emitMeter(ch, name, float64(snapshot.Count()), snapshot.Rate1(), snapshot.Rate5(), snapshot.Rate15())
+			} else {
+				c.emitGauge(ch, name, snapshot.Rate1())
+			}
+		case metrics.Timer:
+			if c.opt.MetricMode != ModeNative {
+				c.emitGauge(ch, name, metric.Snapshot().Rate1())
+			}
+			c.emitHistogram(ch, name, metric, c.timerBuckets, "timer")
+		}
+	})
+}
+
+// Serve runs until ctx is canceled, ticking every interval. It exists only
+// so code written against the old push-style exporter (which refreshed a
+// background map on a timer) keeps compiling: Collect now computes every
+// value fresh on each scrape, so there is nothing left for a background
+// loop to refresh.
+func (c *exporter) Serve(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if c.opt.Debug {
+				fmt.Print("[saramaprom] Serve tick (no-op; Collect computes values on demand)\n")
+			}
+		}
+	}
 }
 
 func (c *exporter) sanitizeName(key string) string {
@@ -39,87 +134,133 @@ func (c *exporter) sanitizeName(key string) string {
 	return string(ret)
 }
 
-func (c *exporter) createKey(name string) string {
-	return c.opt.Namespace + "_" + c.opt.Subsystem + "_" + name
+// stale reports whether rawKey should be skipped this scrape because its
+// value hasn't changed within opt.TTL. Once a key is expired it stays
+// expired — and keeps being skipped on every subsequent scrape — until its
+// value actually changes again; see expireIfStale. kindKey is the caller's
+// already-resolved, sanitized metricKinds key (e.g. what it's about to
+// pass to checkMetricConflict), forwarded to forget so a reappearing
+// series's type gets forgotten under the exact key it was registered
+// under, not a key re-derived from scratch.
+func (c *exporter) stale(rawKey, kindKey string, val float64) bool {
+	if !c.expireIfStale(rawKey, val) {
+		return false
+	}
+	if c.opt.Debug {
+		fmt.Printf("[saramaprom] skipping stale metric %q (unchanged for longer than TTL)\n", rawKey)
+	}
+	c.forget(rawKey, kindKey)
+	return true
 }
 
-func (c *exporter) gaugeFromNameAndValue(name string, val float64) error {
-	shortName, labels, skip := c.metricNameAndLabels(name)
-	if skip {
-		if c.opt.Debug {
-			fmt.Printf("[saramaprom] skip metric %q because there is no broker or topic labels\n", name)
-		}
-		return nil
+// expireIfStale reports whether name's value has been unchanged for longer
+// than opt.TTL, recording val as the current value as a side effect. A TTL
+// of zero disables expiration entirely.
+//
+// A name that has already expired is kept marked as expired in c.expired
+// rather than having its lastValue/lastUpdate entries deleted: if they were
+// deleted here, the very next scrape would see an unseen key, treat val as
+// new, and un-expire the metric for another full TTL window before
+// expiring it again, flickering forever instead of staying suppressed.
+// expired is only cleared once val actually differs from the last value we
+// recorded, i.e. the series has genuinely come back to life.
+func (c *exporter) expireIfStale(name string, val float64) bool {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prev, seen := c.lastValue[name]
+	if !seen || prev != val {
+		c.lastValue[name] = val
+		c.lastUpdate[name] = now
+		delete(c.expired, name)
+		return false
 	}
-
-	if _, exists := c.gauges[name]; !exists {
-		labelNames := make([]string, 0, len(labels))
-		for labelName := range labels {
-			labelNames = append(labelNames, labelName)
-		}
-
-		c.mu.Lock()
-		metricName := c.sanitizeName(shortName)
-		if c.metricsNameMap[metricName] {
-			c.mu.Unlock()
-			return nil
-		}
-		c.metricsNameMap[metricName] = true
-		c.mu.Unlock()
-
-		g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: c.sanitizeName(c.opt.Namespace),
-			Subsystem: c.sanitizeName(c.opt.Subsystem),
-			Name:      c.sanitizeName(shortName),
-			Help:      shortName,
-		}, labelNames)
-
-		if err := c.promRegistry.Register(g); err != nil {
-			switch err := err.(type) {
-			case prometheus.AlreadyRegisteredError:
-				var ok bool
-				g, ok = err.ExistingCollector.(*prometheus.GaugeVec)
-				if !ok {
-					return fmt.Errorf("prometheus collector already registered but it's not *prometheus.GaugeVec: %v", g)
-				}
-			default:
-				return err
-			}
-		}
-		c.gauges[name] = g.With(labels)
+	if c.expired[name] {
+		return true
 	}
-
-	c.gauges[name].Set(val)
-	return nil
+	if c.opt.TTL > 0 && now.Sub(c.lastUpdate[name]) > c.opt.TTL {
+		c.expired[name] = true
+		return true
+	}
+	return false
 }
 
-func (c *exporter) metricNameAndLabels(metricName string) (newName string, labels map[string]string, skip bool) {
-	newName, broker, topic := parseMetricName(metricName)
-	if broker == "" && topic == "" {
-		// skip metrics for total
-		return newName, labels, true
-	}
+// forget drops the bookkeeping for labelsKey/kindKey that doesn't matter
+// once it's known to be expired: the cached label set (so a reappearing
+// series is resolved fresh) and the conflict-checked kind under kindKey (so
+// a reappearing series can register fresh, including under a different
+// metric kind). Both keys must be exactly the ones the caller resolved the
+// metric under — re-deriving them here via the legacy
+// broker/topic-suffix parser, instead of reusing what
+// metricNameAndLabels/applyMappingRules already produced, is what used to
+// leave a MappingRule-renamed metric's kind stuck under a key that was
+// never actually registered. lastValue, lastUpdate and expired are
+// deliberately left alone — deleting them here is exactly what used to
+// make expiry flicker on and off; see expireIfStale.
+func (c *exporter) forget(labelsKey, kindKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.labelsMap, labelsKey)
+	delete(c.metricKinds, kindKey)
+}
 
+func (c *exporter) metricNameAndLabels(metricName string) (newName string, lbls labels, skip bool) {
 	var ok bool
 	c.mu.RLock()
-	labels, ok = c.labelsMap[metricName]
+	lbls, ok = c.labelsMap[metricName]
 	c.mu.RUnlock()
+	if ok {
+		if ruleName, _, _, matched := c.applyMappingRules(metricName); matched {
+			return ruleName, lbls, false
+		}
+		newName, _, _ = parseMetricName(metricName)
+		return newName, lbls, false
+	}
 
-	if !ok {
-		labels = c.opt.Labels
-		if broker != "" {
-			labels["broker"] = broker
+	if ruleName, extra, keepTotal, matched := c.applyMappingRules(metricName); matched {
+		if len(extra) == 0 && !keepTotal {
+			return ruleName, nil, true
 		}
-		if topic != "" {
-			labels["topic"] = topic
+
+		merged := make(labels, len(c.baseLabels)+len(extra))
+		for k, v := range c.baseLabels {
+			merged[k] = v
+		}
+		for k, v := range extra {
+			merged[k] = v
 		}
 
 		c.mu.Lock()
-		c.labelsMap[metricName] = labels
+		c.labelsMap[metricName] = merged
 		c.mu.Unlock()
+		return ruleName, merged, false
+	}
+
+	// No mapping rule matched: fall back to the original
+	// "-for-broker-"/"-for-topic-" suffix convention.
+	newName, broker, topic := parseMetricName(metricName)
+	if broker == "" && topic == "" {
+		// skip metrics for total
+		return newName, nil, true
+	}
+
+	merged := make(labels, len(c.baseLabels)+2)
+	for k, v := range c.baseLabels {
+		merged[k] = v
+	}
+	if broker != "" {
+		merged["broker"] = broker
+	}
+	if topic != "" {
+		merged["topic"] = topic
 	}
 
-	return newName, labels, false
+	c.mu.Lock()
+	c.labelsMap[metricName] = merged
+	c.mu.Unlock()
+
+	return newName, merged, false
 }
 
 func parseMetricName(name string) (newName, broker, topic string) {
@@ -136,136 +277,185 @@ func parseMetricName(name string) (newName, broker, topic string) {
 	return name, "", ""
 }
 
-func (c *exporter) histogramFromNameAndMetric(name string, goMetric interface{}, buckets []float64) error {
-	key := c.createKey(name)
-	collector, exists := c.customMetrics[key]
-	if !exists {
-		collector = newCustomCollector(&c.mu)
-		c.promRegistry.MustRegister(collector)
-		c.customMetrics[key] = collector
+// labelPairs returns lbls' names (sorted, for a stable Desc across calls)
+// and their corresponding values.
+func labelPairs(lbls labels) (names, values []string) {
+	names = make([]string, 0, len(lbls))
+	for k := range lbls {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	values = make([]string, len(names))
+	for i, k := range names {
+		values[i] = lbls[k]
 	}
+	return names, values
+}
 
+// emitGauge resolves the raw sarama metric name and, unless it should be
+// skipped, sends it to ch as a prometheus.GaugeValue.
+func (c *exporter) emitGauge(ch chan<- prometheus.Metric, name string, val float64) {
+	shortName, lbls, skip := c.metricNameAndLabels(name)
+	if skip {
+		if c.opt.Debug {
+			fmt.Printf("[saramaprom] skip metric %q because there is no broker or topic labels\n", name)
+		}
+		return
+	}
+	c.emitResolvedGauge(ch, name, shortName, lbls, val)
+}
+
+// emitResolvedGauge is emitGauge for a caller (such as emitMeter) that
+// already resolved shortName/lbls itself, so several derived series (e.g.
+// rate1/rate5/rate15) can share one name resolution.
+func (c *exporter) emitResolvedGauge(ch chan<- prometheus.Metric, rawKey, shortName string, lbls labels, val float64) {
+	metricName := c.sanitizeName(shortName)
+	if c.stale(rawKey, metricName, val) {
+		return
+	}
+	if err := c.checkMetricConflict(metricName, kindGauge); err != nil {
+		if c.opt.Debug {
+			fmt.Printf("[saramaprom] %v\n", err)
+		}
+		return
+	}
+
+	labelNames, labelValues := labelPairs(lbls)
+	desc := prometheus.NewDesc(
+		prometheus.BuildFQName(c.sanitizeName(c.opt.Namespace), c.sanitizeName(c.opt.Subsystem), metricName),
+		shortName,
+		labelNames,
+		nil,
+	)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val, labelValues...)
+}
+
+// emitHistogram resolves name and, unless it should be skipped, sends it to
+// ch as either a prometheus.ConstSummary (ModeGaugeCompat) or a
+// prometheus.ConstHistogram (ModeNative) built from goMetric.
+//
+// These are genuinely different shapes, not just a naming choice: a
+// ConstSummary reports the value AT each quantile in buckets (so buckets is
+// a list of quantiles like 0.99), while a ConstHistogram reports the
+// cumulative COUNT of samples at or under each bucket boundary (so buckets
+// is a list of latency thresholds). Computing the latter requires the
+// metric's raw sample values, not its quantile values, which is why this
+// binds its own counts from goMetric's Sample() rather than reusing
+// Percentiles for both.
+func (c *exporter) emitHistogram(ch chan<- prometheus.Metric, name string, goMetric interface{}, buckets []float64, typeName string) {
 	var ps []float64
+	var rawValues []int64
 	var count uint64
 	var sum float64
-	var typeName string
 
 	switch metric := goMetric.(type) {
 	case metrics.Histogram:
 		snapshot := metric.Snapshot()
 		ps = snapshot.Percentiles(buckets)
+		rawValues = snapshot.Sample().Values()
 		count = uint64(snapshot.Count())
 		sum = float64(snapshot.Sum())
-		typeName = "histogram"
 	case metrics.Timer:
 		snapshot := metric.Snapshot()
 		ps = snapshot.Percentiles(buckets)
+		rawValues = snapshot.Sample().Values()
 		count = uint64(snapshot.Count())
 		sum = float64(snapshot.Sum())
-		typeName = "timer"
 	default:
-		return fmt.Errorf("unexpected metric type %T", goMetric)
-	}
-
-	bucketVals := make(map[float64]uint64)
-	for ii, bucket := range buckets {
-		bucketVals[bucket] = uint64(ps[ii])
+		if c.opt.Debug {
+			fmt.Printf("[saramaprom] unexpected metric type %T for %q\n", goMetric, name)
+		}
+		return
 	}
 
-	name, labels, skip := c.metricNameAndLabels(name)
+	shortName, lbls, skip := c.metricNameAndLabels(name)
 	if skip {
-		return nil
+		if c.opt.Debug {
+			fmt.Printf("[saramaprom] skip metric %q because there is no broker or topic labels\n", name)
+		}
+		return
 	}
-
-	c.mu.Lock()
-	metricName := c.sanitizeName(name) + "_" + typeName
-	if c.metricsNameMap[metricName] {
-		c.mu.Unlock()
-		return nil
+	// TTL bookkeeping is tracked under name+typeName, not name: in
+	// ModeGaugeCompat, Collect also emits a last-sample gauge mirror under
+	// name itself (see Collect's metrics.Histogram/metrics.Timer cases),
+	// and that value almost never matches this histogram's cumulative sum.
+	// Sharing one TTL key between the two would make expireIfStale see "the
+	// value changed" on every scrape — whichever of the two ran most
+	// recently — so TTL expiration would never actually fire for either.
+	// forget's labelsKey is still the plain name, since that's what
+	// labelsMap is keyed by; its kindKey is metricName below, computed the
+	// same way checkMetricConflict will use it.
+	metricName := c.sanitizeName(shortName) + "_" + typeName
+	histKey := name + "_" + typeName
+	if c.expireIfStale(histKey, sum) {
+		if c.opt.Debug {
+			fmt.Printf("[saramaprom] skipping stale metric %q (unchanged for longer than TTL)\n", histKey)
+		}
+		c.forget(name, metricName)
+		return
 	}
-	c.metricsNameMap[metricName] = true
-	c.mu.Unlock()
 
+	labelNames, labelValues := labelPairs(lbls)
 	desc := prometheus.NewDesc(
-		prometheus.BuildFQName(
-			c.sanitizeName(c.opt.Namespace),
-			c.sanitizeName(c.opt.Subsystem),
-			metricName,
-		),
-		c.sanitizeName(name),
+		prometheus.BuildFQName(c.sanitizeName(c.opt.Namespace), c.sanitizeName(c.opt.Subsystem), metricName),
+		c.sanitizeName(shortName),
+		labelNames,
 		nil,
-		labels,
 	)
 
-	hist, err := prometheus.NewConstHistogram(desc, count, sum, bucketVals)
-	if err != nil {
-		return err
-	}
-	c.mu.Lock()
-	collector.metric = hist
-	c.mu.Unlock()
-	return nil
-}
-
-func (c *exporter) update() error {
-	if c.opt.Debug {
-		fmt.Print("[saramaprom] update()\n")
-	}
-	var err error
-	c.registry.Each(func(name string, i interface{}) {
-		switch metric := i.(type) {
-		case metrics.Counter:
-			err = c.gaugeFromNameAndValue(name, float64(metric.Count()))
-		case metrics.Gauge:
-			err = c.gaugeFromNameAndValue(name, float64(metric.Value()))
-		case metrics.GaugeFloat64:
-			err = c.gaugeFromNameAndValue(name, float64(metric.Value()))
-		case metrics.Histogram: // sarama
-			samples := metric.Snapshot().Sample().Values()
-			if len(samples) > 0 {
-				lastSample := samples[len(samples)-1]
-				err = c.gaugeFromNameAndValue(name, float64(lastSample))
-			}
-			if err == nil {
-				err = c.histogramFromNameAndMetric(name, metric, c.histogramBuckets)
+	if c.opt.MetricMode == ModeNative {
+		if err := c.checkMetricConflict(metricName, kindHistogram); err != nil {
+			if c.opt.Debug {
+				fmt.Printf("[saramaprom] %v\n", err)
 			}
-		case metrics.Meter: // sarama
-			lastSample := metric.Snapshot().Rate1()
-			err = c.gaugeFromNameAndValue(name, float64(lastSample))
-		case metrics.Timer:
-			lastSample := metric.Snapshot().Rate1()
-			err = c.gaugeFromNameAndValue(name, float64(lastSample))
-			if err == nil {
-				err = c.histogramFromNameAndMetric(name, metric, c.timerBuckets)
+			return
+		}
+		hist, err := prometheus.NewConstHistogram(desc, count, sum, cumulativeBucketCounts(rawValues, buckets), labelValues...)
+		if err != nil {
+			if c.opt.Debug {
+				fmt.Printf("[saramaprom] building histogram for %q: %v\n", name, err)
 			}
+			return
 		}
-	})
-	return err
-}
-
-// for collecting prometheus.constHistogram objects
-type customCollector struct {
-	prometheus.Collector
-
-	metric prometheus.Metric
-	mu     sync.Locker
-}
-
-func newCustomCollector(mu sync.Locker) *customCollector {
-	return &customCollector{
-		mu: mu,
+		ch <- hist
+		return
 	}
-}
 
-func (c *customCollector) Collect(ch chan<- prometheus.Metric) {
-	c.mu.Lock()
-	if c.metric != nil {
-		val := c.metric
-		ch <- val
+	if err := c.checkMetricConflict(metricName, kindSummary); err != nil {
+		if c.opt.Debug {
+			fmt.Printf("[saramaprom] %v\n", err)
+		}
+		return
 	}
-	c.mu.Unlock()
+	quantileVals := make(map[float64]float64, len(buckets))
+	for i, q := range buckets {
+		quantileVals[q] = ps[i]
+	}
+	summary, err := prometheus.NewConstSummary(desc, count, sum, quantileVals, labelValues...)
+	if err != nil {
+		if c.opt.Debug {
+			fmt.Printf("[saramaprom] building summary for %q: %v\n", name, err)
+		}
+		return
+	}
+	ch <- summary
 }
 
-func (c *customCollector) Describe(_ chan<- *prometheus.Desc) {
-	// empty method to fulfill prometheus.Collector interface
+// cumulativeBucketCounts bins values against buckets the way a Prometheus
+// histogram's le buckets work: bucketCounts[b] is the number of values less
+// than or equal to b. buckets need not be pre-sorted; each is scanned
+// independently since sarama histograms/timers hold at most a few thousand
+// samples per scrape.
+func cumulativeBucketCounts(values []int64, buckets []float64) map[float64]uint64 {
+	counts := make(map[float64]uint64, len(buckets))
+	for _, b := range buckets {
+		var n uint64
+		for _, v := range values {
+			if float64(v) <= b {
+				n++
+			}
+		}
+		counts[b] = n
+	}
+	return counts
 }
@@ -0,0 +1,109 @@
+package saramaprom
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+)
+
+// drainMetrics reads every prometheus.Metric currently buffered in ch
+// without blocking, so a test can call Collect and inspect bookkeeping
+// afterward without needing a real Gather on the other end.
+func drainMetrics(ch chan prometheus.Metric) {
+	for {
+		select {
+		case <-ch:
+		default:
+			return
+		}
+	}
+}
+
+// TestForgetClearsMappingRuleRenamedKind is a regression test for a bug
+// where forget() recomputed a metric's short name via the hardcoded
+// broker/topic-suffix parser instead of the MappingRule-aware resolution
+// Collect itself uses, leaving metricKinds stuck under a key that was
+// never actually registered for any metric a MappingRule renamed.
+func TestForgetClearsMappingRuleRenamedKind(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterGauge("custom-metric", registry).Update(1)
+
+	exp, err := NewUnregistered(registry, Options{
+		TTL: time.Millisecond,
+		MappingRules: []MappingRule{
+			{Match: "custom-metric", Name: "renamed_metric", KeepTotal: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUnregistered: %v", err)
+	}
+
+	ch := make(chan prometheus.Metric, 8)
+	exp.Collect(ch)
+	drainMetrics(ch)
+
+	exp.mu.RLock()
+	_, tracked := exp.metricKinds["renamed_metric"]
+	exp.mu.RUnlock()
+	if !tracked {
+		t.Fatalf("expected metricKinds[%q] to be set after the first Collect", "renamed_metric")
+	}
+
+	exp.mu.Lock()
+	exp.lastUpdate["custom-metric"] = time.Now().Add(-time.Hour)
+	exp.mu.Unlock()
+
+	exp.Collect(ch)
+	drainMetrics(ch)
+
+	exp.mu.RLock()
+	_, stillTracked := exp.metricKinds["renamed_metric"]
+	exp.mu.RUnlock()
+	if stillTracked {
+		t.Errorf("metricKinds[%q] is still set after the metric expired; forget used the wrong key", "renamed_metric")
+	}
+}
+
+// BenchmarkCollectConcurrentBrokersTopics exercises Collect from many
+// goroutines at once against a registry with many distinct brokers/topics,
+// so the concurrency invariant documented on exporter (Collect must be safe
+// to call concurrently with itself) is checked by `go test -race
+// -bench=. -benchtime=1x`, not just asserted in a comment.
+func BenchmarkCollectConcurrentBrokersTopics(b *testing.B) {
+	const brokers = 20
+	const topics = 20
+
+	registry := metrics.NewRegistry()
+	for i := 0; i < brokers; i++ {
+		metrics.GetOrRegisterGauge(fmt.Sprintf("request-rate-for-broker-%d", i), registry).Update(int64(i))
+	}
+	for i := 0; i < topics; i++ {
+		metrics.GetOrRegisterCounter(fmt.Sprintf("incoming-byte-rate-for-topic-%d", i), registry).Inc(int64(i))
+		metrics.GetOrRegisterHistogram(fmt.Sprintf("request-size-for-topic-%d", i), registry, metrics.NewUniformSample(64)).Update(int64(i))
+	}
+
+	exp, err := New(registry, prometheus.NewRegistry(), Options{})
+	if err != nil {
+		b.Fatalf("New: %v", err)
+	}
+
+	ch := make(chan prometheus.Metric, brokers+topics*4)
+	done := make(chan struct{})
+	go func() {
+		for range ch {
+		}
+		close(done)
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			exp.Collect(ch)
+		}
+	})
+	close(ch)
+	<-done
+}
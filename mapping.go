@@ -0,0 +1,146 @@
+package saramaprom
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// MatchType selects how MappingRule.Match is interpreted.
+type MatchType int
+
+const (
+	// MatchGlob treats Match as a shell glob such as
+	// "kafka-requests-for-broker-*", with each "*" becoming a capture
+	// group usable from Name/Labels templates ($1, $2, ...).
+	MatchGlob MatchType = iota
+	// MatchRegex treats Match as a regular expression; its capture groups
+	// (numbered or named) are usable from Name/Labels templates.
+	MatchRegex
+)
+
+// MappingRule rewrites a raw sarama metric name into a Prometheus metric
+// name plus a set of labels, the way a statsd_exporter mapping config entry
+// rewrites a dotted statsd name.
+type MappingRule struct {
+	// Match is the pattern tested against the raw sarama metric name.
+	Match string
+	// MatchType selects how Match is interpreted. Defaults to MatchGlob.
+	MatchType MatchType
+	// Name is the rewritten metric name. It may reference capture groups
+	// as $1, $2, ... (or $name for named regex groups). Empty means keep
+	// the matched name unchanged.
+	Name string
+	// Labels maps a label name to a capture-group template, e.g.
+	// {"broker": "$1"}.
+	Labels map[string]string
+	// KeepTotal, when true, exposes a match with no resulting labels
+	// instead of skipping it. sarama emits "-total" style metrics that
+	// carry neither broker nor topic; the old hardcoded parser always
+	// skipped those, so the default here preserves that behavior.
+	KeepTotal bool
+
+	re     *regexp.Regexp
+	prefix string // literal text before the first wildcard/metachar, for GlobDisableOrdering sorting
+}
+
+func (r *MappingRule) compile() error {
+	switch r.MatchType {
+	case MatchRegex:
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return fmt.Errorf("saramaprom: invalid MappingRule regex %q: %w", r.Match, err)
+		}
+		r.re = re
+		r.prefix = literalPrefix(r.Match)
+	default:
+		re, err := globToRegexp(r.Match)
+		if err != nil {
+			return fmt.Errorf("saramaprom: invalid MappingRule glob %q: %w", r.Match, err)
+		}
+		r.re = re
+		r.prefix = strings.SplitN(r.Match, "*", 2)[0]
+	}
+	return nil
+}
+
+// globToRegexp compiles a shell glob into a regexp where each "*" becomes a
+// capturing group, so glob rules can use $1/$2 templates the same way
+// regex rules use their own capture groups.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	parts := strings.Split(glob, "*")
+	var b strings.Builder
+	b.WriteString("^")
+	for i, part := range parts {
+		b.WriteString(regexp.QuoteMeta(part))
+		if i != len(parts)-1 {
+			b.WriteString("(.*)")
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// literalMetaChars are the regexp metacharacters that end a pattern's
+// literal prefix.
+const literalMetaChars = `.*+?()|[]{}^$\`
+
+// literalPrefix returns the literal text a regexp is anchored on before its
+// first metacharacter, used only to order rules when GlobDisableOrdering is
+// set.
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, literalMetaChars); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// compileMappingRules validates and compiles every rule, and — when
+// disableOrdering is set — reorders a copy so the most specific (longest
+// literal prefix) rules are tried first. statsd_exporter's
+// glob_disable_ordering exists for the same reason: callers whose rules
+// are mutually exclusive by construction can skip paying for strict
+// first-match-wins evaluation order.
+func compileMappingRules(rules []MappingRule, disableOrdering bool) ([]MappingRule, error) {
+	compiled := make([]MappingRule, len(rules))
+	copy(compiled, rules)
+	for i := range compiled {
+		if err := compiled[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	if disableOrdering {
+		sort.SliceStable(compiled, func(i, j int) bool {
+			return len(compiled[i].prefix) > len(compiled[j].prefix)
+		})
+	}
+	return compiled, nil
+}
+
+// applyMappingRules walks the compiled mapping rules in order and returns
+// the first match. When nothing matches it returns matched == false, and
+// metricNameAndLabels falls back to the legacy "-for-broker-"/"-for-topic-"
+// suffix convention.
+func (c *exporter) applyMappingRules(name string) (newName string, extraLabels map[string]string, keepTotal, matched bool) {
+	for i := range c.mappingRules {
+		rule := &c.mappingRules[i]
+		loc := rule.re.FindStringSubmatchIndex(name)
+		if loc == nil {
+			continue
+		}
+
+		newName = name
+		if rule.Name != "" {
+			newName = string(rule.re.ExpandString(nil, rule.Name, name, loc))
+		}
+
+		extraLabels = make(map[string]string, len(rule.Labels))
+		for labelName, tmpl := range rule.Labels {
+			extraLabels[labelName] = string(rule.re.ExpandString(nil, tmpl, name, loc))
+		}
+
+		return newName, extraLabels, rule.KeepTotal, true
+	}
+	return "", nil, false, false
+}
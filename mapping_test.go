@@ -0,0 +1,162 @@
+package saramaprom
+
+import (
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestApplyMappingRulesGlobCapture(t *testing.T) {
+	exp, err := NewUnregistered(metrics.NewRegistry(), Options{
+		MappingRules: []MappingRule{
+			{
+				Match:  "kafka-requests-for-broker-*",
+				Name:   "kafka_requests",
+				Labels: map[string]string{"broker": "$1"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUnregistered: %v", err)
+	}
+
+	newName, extra, keepTotal, matched := exp.applyMappingRules("kafka-requests-for-broker-5")
+	if !matched {
+		t.Fatalf("expected a match")
+	}
+	if newName != "kafka_requests" {
+		t.Errorf("newName = %q, want %q", newName, "kafka_requests")
+	}
+	if keepTotal {
+		t.Errorf("keepTotal = true, want false")
+	}
+	if extra["broker"] != "5" {
+		t.Errorf("broker label = %q, want %q", extra["broker"], "5")
+	}
+}
+
+func TestApplyMappingRulesRegexNamedGroups(t *testing.T) {
+	exp, err := NewUnregistered(metrics.NewRegistry(), Options{
+		MappingRules: []MappingRule{
+			{
+				Match:     `^consumer-fetch-rate-for-topic-(?P<topic>.+)$`,
+				MatchType: MatchRegex,
+				Name:      "consumer_fetch_rate",
+				Labels:    map[string]string{"topic": "$topic"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUnregistered: %v", err)
+	}
+
+	newName, extra, _, matched := exp.applyMappingRules("consumer-fetch-rate-for-topic-orders")
+	if !matched {
+		t.Fatalf("expected a match")
+	}
+	if newName != "consumer_fetch_rate" {
+		t.Errorf("newName = %q, want %q", newName, "consumer_fetch_rate")
+	}
+	if extra["topic"] != "orders" {
+		t.Errorf("topic label = %q, want %q", extra["topic"], "orders")
+	}
+}
+
+func TestMetricNameAndLabelsKeepTotal(t *testing.T) {
+	rule := MappingRule{Match: "kafka-requests-total", Name: "kafka_requests_total"}
+
+	withoutKeepTotal, err := NewUnregistered(metrics.NewRegistry(), Options{MappingRules: []MappingRule{rule}})
+	if err != nil {
+		t.Fatalf("NewUnregistered: %v", err)
+	}
+	if _, _, skip := withoutKeepTotal.metricNameAndLabels("kafka-requests-total"); !skip {
+		t.Errorf("expected a match with no labels and KeepTotal=false to be skipped")
+	}
+
+	rule.KeepTotal = true
+	withKeepTotal, err := NewUnregistered(metrics.NewRegistry(), Options{MappingRules: []MappingRule{rule}})
+	if err != nil {
+		t.Fatalf("NewUnregistered: %v", err)
+	}
+	newName, _, skip := withKeepTotal.metricNameAndLabels("kafka-requests-total")
+	if skip {
+		t.Errorf("expected a match with KeepTotal=true not to be skipped")
+	}
+	if newName != "kafka_requests_total" {
+		t.Errorf("newName = %q, want %q", newName, "kafka_requests_total")
+	}
+}
+
+func TestMetricNameAndLabelsRulePrecedesBrokerTopicFallback(t *testing.T) {
+	exp, err := NewUnregistered(metrics.NewRegistry(), Options{
+		MappingRules: []MappingRule{
+			{
+				Match:  "kafka-requests-for-broker-*",
+				Name:   "kafka_requests_renamed",
+				Labels: map[string]string{"broker_id": "$1"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUnregistered: %v", err)
+	}
+
+	newName, lbls, skip := exp.metricNameAndLabels("kafka-requests-for-broker-5")
+	if skip {
+		t.Fatalf("expected a rule match to not be skipped")
+	}
+	if newName != "kafka_requests_renamed" {
+		t.Errorf("newName = %q, want the rule's rewritten name %q", newName, "kafka_requests_renamed")
+	}
+	if _, ok := lbls["broker"]; ok {
+		t.Errorf("expected the legacy \"broker\" label not to be set once a rule matched, got %v", lbls)
+	}
+	if lbls["broker_id"] != "5" {
+		t.Errorf("broker_id label = %q, want %q", lbls["broker_id"], "5")
+	}
+}
+
+func TestMetricNameAndLabelsFallsBackToBrokerTopicSuffix(t *testing.T) {
+	exp, err := NewUnregistered(metrics.NewRegistry(), Options{
+		MappingRules: []MappingRule{
+			{Match: "unrelated-metric-*", Name: "unrelated"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUnregistered: %v", err)
+	}
+
+	newName, lbls, skip := exp.metricNameAndLabels("kafka-requests-for-broker-3")
+	if skip {
+		t.Fatalf("expected the broker/topic fallback to not skip")
+	}
+	if newName != "kafka-requests" {
+		t.Errorf("newName = %q, want %q", newName, "kafka-requests")
+	}
+	if lbls["broker"] != "3" {
+		t.Errorf("broker label = %q, want %q", lbls["broker"], "3")
+	}
+}
+
+func TestCompileMappingRulesGlobDisableOrdering(t *testing.T) {
+	rules := []MappingRule{
+		{Match: "kafka-*"},
+		{Match: "kafka-requests-for-broker-*"},
+	}
+
+	compiled, err := compileMappingRules(rules, true)
+	if err != nil {
+		t.Fatalf("compileMappingRules: %v", err)
+	}
+	if compiled[0].Match != "kafka-requests-for-broker-*" {
+		t.Errorf("compiled[0].Match = %q, want the more specific (longer literal prefix) rule first", compiled[0].Match)
+	}
+
+	inOrder, err := compileMappingRules(rules, false)
+	if err != nil {
+		t.Fatalf("compileMappingRules: %v", err)
+	}
+	if inOrder[0].Match != "kafka-*" {
+		t.Errorf("inOrder[0].Match = %q, want rules left in declaration order", inOrder[0].Match)
+	}
+}
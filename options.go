@@ -0,0 +1,126 @@
+package saramaprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultHistogramBuckets and defaultTimerBuckets double as the quantiles
+// used to build a ConstSummary (ModeGaugeCompat) and the latency-threshold
+// buckets used to build a ConstHistogram (ModeNative); see emitHistogram.
+var (
+	defaultHistogramBuckets = []float64{0.5, 0.75, 0.95, 0.99}
+	defaultTimerBuckets     = []float64{0.5, 0.75, 0.95, 0.99}
+)
+
+// MetricsRegistry is the subset of github.com/rcrowley/go-metrics's Registry
+// interface that the exporter depends on. It exists so callers (and tests)
+// can supply a fake registry without pulling in the real one.
+type MetricsRegistry interface {
+	Each(func(name string, i interface{}))
+}
+
+// Options configures an exporter.
+type Options struct {
+	Namespace string
+	Subsystem string
+
+	// Labels are attached to every metric exposed by the exporter. New
+	// takes its own copy of this map, so it's safe to reuse or discard
+	// after New returns, but it must not be mutated concurrently with a
+	// call to New itself.
+	Labels map[string]string
+
+	// Debug enables verbose logging to stdout.
+	Debug bool
+
+	// TTL is the maximum amount of time a metric's value is allowed to
+	// stay unchanged before the exporter considers it stale and stops
+	// exposing it. This keeps cardinality bounded when brokers disconnect
+	// or consumer groups churn through topics. Zero (the default) means
+	// metrics never expire, matching statsd_exporter's behavior.
+	TTL time.Duration
+
+	// MetricMode selects how sarama metrics are mapped onto Prometheus
+	// types. Defaults to ModeGaugeCompat for backward compatibility.
+	MetricMode MetricMode
+
+	// MappingRules are tried in order against every raw sarama metric
+	// name; the first match rewrites the name and supplies labels. A
+	// metric that matches no rule falls back to the built-in
+	// "-for-broker-"/"-for-topic-" suffix handling.
+	MappingRules []MappingRule
+
+	// GlobDisableOrdering lets MappingRules be evaluated most-specific
+	// first instead of strictly in the order given, on the assumption
+	// that the caller's rules don't overlap. See statsd_exporter's
+	// glob_disable_ordering for the same trade-off.
+	GlobDisableOrdering bool
+
+	// PushGateway configures PushLoop, the push-mode sink for short-lived
+	// processes that exit before a pull scrape could ever reach them.
+	// PushLoop returns an error at once if URL or Job is empty.
+	PushGateway PushGatewayConfig
+}
+
+// NewUnregistered builds an exporter that reads metrics out of registry on
+// demand, the same way New does, but does not register it with any
+// prometheus.Registerer. Use it when the caller wants to control
+// registration itself — e.g. to register against more than one Registry,
+// or to handle a registration error differently than New's.
+//
+// It returns an error if any Options.MappingRules entry fails to compile.
+func NewUnregistered(registry MetricsRegistry, opt Options) (*exporter, error) {
+	mappingRules, err := compileMappingRules(opt.MappingRules, opt.GlobDisableOrdering)
+	if err != nil {
+		return nil, err
+	}
+
+	baseLabels := make(labels, len(opt.Labels))
+	for k, v := range opt.Labels {
+		baseLabels[k] = v
+	}
+
+	return &exporter{
+		opt:              opt,
+		registry:         registry,
+		histogramBuckets: defaultHistogramBuckets,
+		timerBuckets:     defaultTimerBuckets,
+		baseLabels:       baseLabels,
+		labelsMap:        make(map[string]labels),
+		metricKinds:      make(map[string]metricKind),
+		mappingRules:     mappingRules,
+		lastValue:        make(map[string]float64),
+		lastUpdate:       make(map[string]time.Time),
+		expired:          make(map[string]bool),
+	}, nil
+}
+
+// New builds an exporter via NewUnregistered and registers it as a single
+// prometheus.Collector with promRegistry. It returns an error if
+// registration fails or if any Options.MappingRules entry fails to
+// compile.
+//
+// Breaking change: New used to return a bare *exporter with no error.
+// Compiling Options.MappingRules and registering with promRegistry can
+// both fail, so it now returns (*exporter, error).
+//
+// Registering is a side effect of calling New, not something the caller
+// does separately afterward: call New once per (registry, promRegistry)
+// pair you want scraped. Calling it twice against the same promRegistry
+// won't be caught at registration time — exporter's Describe is
+// intentionally unchecked (see Describe) — but a later Gather will start
+// erroring on the resulting duplicate metric/label sets. Use
+// NewUnregistered if you need to manage registration yourself.
+func New(registry MetricsRegistry, promRegistry prometheus.Registerer, opt Options) (*exporter, error) {
+	exp, err := NewUnregistered(registry, opt)
+	if err != nil {
+		return nil, err
+	}
+	exp.promRegistry = promRegistry
+	if err := promRegistry.Register(exp); err != nil {
+		return nil, err
+	}
+	return exp, nil
+}
@@ -0,0 +1,96 @@
+package saramaprom
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// PushGatewayConfig configures PushLoop. It is the push-mode counterpart of
+// the pull model New sets up: short-lived producer jobs (batch ingestors,
+// cron-driven publishers) exit before Prometheus gets a chance to scrape
+// them, so they push their metrics to a Pushgateway instead.
+type PushGatewayConfig struct {
+	// URL is the Pushgateway base URL, e.g. "http://pushgateway:9091".
+	URL string
+	// Job is the Pushgateway "job" label for this process.
+	Job string
+	// Grouping adds further grouping key labels alongside Job, e.g.
+	// {"instance": hostname}.
+	Grouping map[string]string
+	// Interval is how often PushLoop re-pushes while its context is still
+	// live. Defaults to 15s.
+	Interval time.Duration
+	// Username/Password, if set, are sent as HTTP basic auth on every
+	// push/delete request.
+	Username string
+	Password string
+	// DeleteOnShutdown removes this job's metrics from the gateway when
+	// PushLoop's context is canceled, so a finished batch job doesn't
+	// leave stale series behind.
+	DeleteOnShutdown bool
+}
+
+// PushLoop pushes the exporter's metrics to Options.PushGateway until ctx is
+// canceled, then returns ctx.Err(). It reuses the exporter itself as the
+// prometheus.Collector being pushed, so push mode exposes exactly the same
+// metric names and labels pull mode (Collect) would.
+func (c *exporter) PushLoop(ctx context.Context) error {
+	cfg := c.opt.PushGateway
+	if cfg.URL == "" {
+		return fmt.Errorf("saramaprom: PushLoop requires Options.PushGateway.URL")
+	}
+	if cfg.Job == "" {
+		return fmt.Errorf("saramaprom: PushLoop requires Options.PushGateway.Job")
+	}
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+
+	pusher := push.New(cfg.URL, cfg.Job).Collector(c)
+	for name, value := range cfg.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if cfg.Username != "" || cfg.Password != "" {
+		pusher = pusher.BasicAuth(cfg.Username, cfg.Password)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := pusher.PushContext(ctx); err != nil && c.opt.Debug {
+			fmt.Printf("[saramaprom] push to %s failed: %v\n", cfg.URL, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if cfg.DeleteOnShutdown {
+				// Delete has no context-aware variant, so bound how long
+				// shutdown can block on it ourselves.
+				done := make(chan error, 1)
+				go func() { done <- pusher.Delete() }()
+				select {
+				case err := <-done:
+					if err != nil && c.opt.Debug {
+						fmt.Printf("[saramaprom] delete from %s failed: %v\n", cfg.URL, err)
+					}
+				case <-time.After(deleteTimeout):
+					if c.opt.Debug {
+						fmt.Printf("[saramaprom] delete from %s timed out after %s\n", cfg.URL, deleteTimeout)
+					}
+				}
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// deleteTimeout bounds how long PushLoop waits for the best-effort
+// DeleteOnShutdown call before giving up and returning anyway.
+const deleteTimeout = 5 * time.Second